@@ -3,18 +3,30 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 
+	"github.com/BurntSushi/toml"
+	"github.com/github/depstubber/internal/resolver"
 	"github.com/github/depstubber/model"
+	"github.com/google/licensecheck"
 	"golang.org/x/tools/imports"
+	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -24,10 +36,26 @@ var (
 	writeModuleTxt = flag.Bool("write_module_txt", false, "Write a stub modules.txt to get around the go1.14 vendor check, if necessary.")
 	forceOverwrite = flag.Bool("force", false, "Delete the destination vendor directory if it already exists.")
 )
+var (
+	licenseDetect        = flag.Bool("license-detect", true, "Automatically locate the upstream LICENSE/COPYING/NOTICE file and classify it with google/licensecheck; ignored when -copyright_file is set.")
+	licenseMinConfidence = flag.Float64("license-min-confidence", 0.9, "Minimum licensecheck match confidence (0-1) required to accept a license classification.")
+	licenseFailOnUnknown = flag.Bool("license-fail-on-unknown", false, "Fail instead of generating a stub when the upstream license cannot be classified with sufficient confidence.")
+)
 var (
 	modeAutoDetection      = flag.Bool("auto", false, "Automatically detect and stub dependencies of the Go package in the current directory.")
 	modePrintGoGenComments = flag.Bool("print", false, "Automatically detect and generate 'go generate' comments for the Go package in the current directory.")
 )
+var (
+	fetchMode = flag.Bool("fetch", false, "Resolve the target package with 'go mod download' into a throwaway module instead of requiring it to be importable from the working directory's module. Enabled automatically when the package can't be resolved locally.")
+)
+var (
+	bundlePackage = flag.String("bundle", "", "Merge every package discovered by -auto (or passed on the command line) into a single self-contained file with this import path, analogous to golang.org/x/tools/cmd/bundle. Exported identifiers are prefixed per source package to avoid collisions.")
+)
+var (
+	configPath    = flag.String("config", "", "Path to a depstubber.toml (or .yaml) file listing per-package types/functions/vars to stub; auto-discovered at the module root when unset.")
+	configOutPath = flag.String("config-out", "", "With -print, write the auto-detected packages to this config file instead of printing 'go generate' comments.")
+	verifyMode    = flag.Bool("verify", false, "With -config, fail instead of (re)writing stubs that would differ from what's already on disk.")
+)
 
 func main() {
 	flag.Usage = usage
@@ -40,10 +68,25 @@ func main() {
 	}
 
 	if *modePrintGoGenComments {
+		// Warm the resolver cache so a following '-auto' run (or 'go
+		// generate' invoking depstubber per package) hits it instead of
+		// re-running 'go list -m -json all'.
+		if _, err := loadResolver("."); err != nil {
+			log.Printf("Warning: module resolver unavailable: %v", err)
+		}
+
 		pathToTypeNames, pathToFuncAndVarNames, _, err := autoDetect(".", ".")
 		if err != nil {
 			log.Fatalf("Error while auto-detecting imported objects: %s", err)
 		}
+
+		if *configOutPath != "" {
+			if err := writeConfigFile(*configOutPath, pathToTypeNames, pathToFuncAndVarNames); err != nil {
+				log.Fatalf("Failed to write config file: %v", err)
+			}
+			return
+		}
+
 		printGoGenerateComments(pathToTypeNames, pathToFuncAndVarNames)
 		return
 	}
@@ -65,6 +108,20 @@ func main() {
 		}
 	}
 
+	configFile := *configPath
+	if configFile == "" {
+		if path, ok := discoverConfig("."); ok {
+			configFile = path
+		}
+	}
+	if configFile != "" {
+		runConfig(configFile)
+		if *vendor {
+			stubModulesTxt()
+		}
+		return
+	}
+
 	if *modeAutoDetection {
 		pathToTypeNames, pathToFuncAndVarNames, pathToDirs, err := autoDetect(".", ".")
 		if err != nil {
@@ -82,31 +139,149 @@ func main() {
 			sort.Strings(pkgPaths)
 		}
 
-		for _, pkgPath := range pkgPaths {
-			createStubs(
-				pkgPath,
-				pathToTypeNames[pkgPath],
-				pathToFuncAndVarNames[pkgPath],
-				pathToDirs[pkgPath],
-			)
+		res, err := loadResolver(".")
+		if err != nil {
+			log.Printf("Warning: module resolver unavailable, falling back to per-package detection: %v", err)
+		}
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatalf("Unable to load current directory: %v", err)
+		}
+
+		if *bundlePackage != "" {
+			entries := make([]bundleEntry, 0, len(pkgPaths))
+			for _, pkgPath := range pkgPaths {
+				entries = append(entries, bundleEntry{
+					pkgPath:         pkgPath,
+					typeNames:       pathToTypeNames[pkgPath],
+					funcAndVarNames: pathToFuncAndVarNames[pkgPath],
+					licenseDirs:     resolveDirs(res, wd, pkgPath, pathToDirs[pkgPath]),
+				})
+			}
+			createBundle(*bundlePackage, "", entries)
+		} else {
+			for _, pkgPath := range pkgPaths {
+				createStubs(
+					pkgPath,
+					pathToTypeNames[pkgPath],
+					pathToFuncAndVarNames[pkgPath],
+					resolveDirs(res, wd, pkgPath, pathToDirs[pkgPath]),
+				)
+			}
 		}
 	} else {
 		if flag.NArg() != 2 && flag.NArg() != 3 {
 			usage()
 			log.Fatal("Expected exactly two or three arguments")
 		}
-		packageName := flag.Arg(0)
-		createStubs(packageName, split(flag.Arg(1)), split(flag.Arg(2)), nil)
+		packageName, version := splitImportPathVersion(flag.Arg(0))
+		fetchDir := ""
+		var licenseDirs []string
+		if *fetchMode || !packageResolvesLocally(packageName) {
+			dir, resolvedVersion, err := fetchPackage(packageName, version)
+			if err != nil {
+				log.Fatalf("Failed to fetch %s: %v", packageName, err)
+			}
+			defer os.RemoveAll(dir)
+			fetchDir, version = dir, resolvedVersion
+			log.Printf("Fetched %s@%s into %s", packageName, version, dir)
+			// The license lives in the module cache, not the throwaway
+			// module at fetchDir; detectLicense's version-based fallback
+			// (see findLicenseFile) locates it from packageName@version.
+		} else {
+			res, err := loadResolver(".")
+			if err != nil {
+				log.Printf("Warning: module resolver unavailable, falling back to auto-discovered license dirs: %v", err)
+			}
+			licenseDirs = resolveDirs(res, ".", packageName, nil)
+		}
+
+		if *bundlePackage != "" {
+			entries := []bundleEntry{{
+				pkgPath:         packageName,
+				version:         version,
+				typeNames:       split(flag.Arg(1)),
+				funcAndVarNames: split(flag.Arg(2)),
+				licenseDirs:     licenseDirs,
+			}}
+			createBundle(*bundlePackage, fetchDir, entries)
+		} else {
+			createStubsIn(fetchDir, packageName, version, split(flag.Arg(1)), split(flag.Arg(2)), licenseDirs)
+		}
 	}
 	if *vendor {
 		stubModulesTxt()
 	}
 }
 
+// loadResolver builds (or loads from the on-disk cache keyed by go.sum's
+// hash) the module resolution table described in internal/resolver.
+func loadResolver(wd string) (*resolver.Resolver, error) {
+	root := findModuleRoot(wd)
+	goSum := filepath.Join(root, "go.sum")
+
+	key, err := resolver.CacheKey(goSum)
+	if err != nil {
+		// No go.sum (e.g. a dependency-free module): build without caching.
+		return resolver.New(root)
+	}
+
+	if r, ok := resolver.LoadCached(key); ok {
+		return r, nil
+	}
+
+	r, err := resolver.New(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Save(key); err != nil {
+		log.Printf("Warning: failed to cache module resolution table: %v", err)
+	}
+	return r, nil
+}
+
+// resolveDirs resolves pkgPath via res (including its on-demand 'go list -json'
+// fallback, see Resolver.Resolve), falling back to legacy if res can't.
+func resolveDirs(res *resolver.Resolver, wd, pkgPath string, legacy []string) []string {
+	if res == nil {
+		return legacy
+	}
+	if dir, err := res.ResolveDir(wd, pkgPath); err == nil && dir != "" {
+		return []string{dir}
+	}
+	return legacy
+}
+
+// reflectModeIn runs reflectMode from within fetchDir (see -fetch) instead
+// of the current working directory, when fetchDir is non-empty.
+func reflectModeIn(fetchDir, packageName string, typeNames, funcAndVarNames []string) (*model.PackedPkg, error) {
+	if fetchDir == "" {
+		return reflectMode(packageName, typeNames, funcAndVarNames)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("get current directory failed: %v", err)
+	}
+	if err := os.Chdir(fetchDir); err != nil {
+		return nil, fmt.Errorf("unable to enter fetched module at %s: %v", fetchDir, err)
+	}
+	pkg, err := reflectMode(packageName, typeNames, funcAndVarNames)
+	if chdirErr := os.Chdir(wd); chdirErr != nil {
+		return nil, fmt.Errorf("unable to return to %s: %v", wd, chdirErr)
+	}
+	return pkg, err
+}
+
+// createStubs generates a stub for packageName using packages resolvable
+// from the current working directory's module.
 func createStubs(packageName string, typeNames []string, funcAndVarNames []string, licenseDirs []string) {
+	createStubsIn("", packageName, "", typeNames, funcAndVarNames, licenseDirs)
+}
 
-	var pkg *model.PackedPkg
-	var err error
+// createStubsIn is createStubs, but builds the reflection program inside
+// fetchDir (see -fetch) instead of the caller's working directory when set.
+func createStubsIn(fetchDir string, packageName string, version string, typeNames []string, funcAndVarNames []string, licenseDirs []string) {
 
 	if packageName == "." {
 		dir, err := os.Getwd()
@@ -119,8 +294,7 @@ func createStubs(packageName string, typeNames []string, funcAndVarNames []strin
 		}
 	}
 
-	pkg, err = reflectMode(packageName, typeNames, funcAndVarNames)
-
+	pkg, err := reflectModeIn(fetchDir, packageName, typeNames, funcAndVarNames)
 	if err != nil {
 		log.Fatalf("Loading input failed: %v", err)
 	}
@@ -149,9 +323,11 @@ func createStubs(packageName string, typeNames []string, funcAndVarNames []strin
 
 	g := new(generator)
 	g.srcPackage = packageName
+	g.srcVersion = version
 	g.srcExports = strings.Join(typeNames, ",")
 	g.srcFunctions = strings.Join(funcAndVarNames, ",")
 
+	var lic *detectedLicense
 	if *copyrightFile != "" {
 		header, err := ioutil.ReadFile(*copyrightFile)
 		if err != nil {
@@ -159,6 +335,18 @@ func createStubs(packageName string, typeNames []string, funcAndVarNames []strin
 		}
 
 		g.copyrightHeader = string(header)
+	} else if *licenseDetect {
+		var err error
+		lic, err = detectLicense(licenseDirs, packageName, version)
+		if err != nil {
+			log.Fatalf("Failed to auto-detect upstream license: %v", err)
+		}
+		if lic != nil {
+			g.copyrightHeader = lic.Text
+			g.spdxIdentifier = lic.SPDX
+		} else if *licenseFailOnUnknown {
+			log.Fatalf("Unable to classify the upstream license for %s with confidence >= %.2f, and -license-fail-on-unknown is set", packageName, *licenseMinConfidence)
+		}
 	} else {
 		// check that there is a LICENSE file
 	}
@@ -170,32 +358,609 @@ func createStubs(packageName string, typeNames []string, funcAndVarNames []strin
 		log.Fatalf("Failed writing to destination: %v", err)
 	}
 
-	if err := copyLicenses(licenseDirs); err != nil {
+	// Reuse the file detectLicense already located, if any.
+	copyFrom := licenseDirs
+	if lic != nil {
+		copyFrom = []string{filepath.Dir(lic.Path)}
+	}
+	if err := copyLicenses(copyFrom); err != nil {
 		log.Fatalf("Failed to find/copy licenses: %v", err)
 	}
 }
 
+// bundleEntry is one source package folded into a -bundle output file.
+type bundleEntry struct {
+	pkgPath         string
+	version         string // may be empty; set from an "@version" argument, a config entry's version, or -fetch
+	typeNames       []string
+	funcAndVarNames []string
+	licenseDirs     []string
+	pkg             *model.PackedPkg
+}
+
+// createBundle merges entries into a single self-contained package at
+// bundlePackage. When fetchDir is non-empty (see -fetch), the reflection
+// programs are built from within it. Like createStubsIn, each entry's
+// upstream license is detected (unless -copyright_file is set) and copied
+// alongside the bundle's output.
+func createBundle(bundlePackage string, fetchDir string, entries []bundleEntry) {
+	var copyFrom []string
+	var headers []string
+	for i := range entries {
+		e := &entries[i]
+		pkg, err := reflectModeIn(fetchDir, e.pkgPath, e.typeNames, e.funcAndVarNames)
+		if err != nil {
+			log.Fatalf("Loading input for %s failed: %v", e.pkgPath, err)
+		}
+		e.pkg = pkg
+
+		if *copyrightFile == "" && *licenseDetect {
+			lic, err := detectLicense(e.licenseDirs, e.pkgPath, e.version)
+			if err != nil {
+				log.Fatalf("Failed to auto-detect upstream license for %s: %v", e.pkgPath, err)
+			}
+			if lic != nil {
+				headers = append(headers, fmt.Sprintf("%s (%s):\n%s", e.pkgPath, lic.SPDX, lic.Text))
+				copyFrom = append(copyFrom, filepath.Dir(lic.Path))
+			} else {
+				copyFrom = append(copyFrom, e.licenseDirs...)
+				if *licenseFailOnUnknown {
+					log.Fatalf("Unable to classify the upstream license for %s with confidence >= %.2f, and -license-fail-on-unknown is set", e.pkgPath, *licenseMinConfidence)
+				}
+			}
+		} else {
+			copyFrom = append(copyFrom, e.licenseDirs...)
+		}
+	}
+
+	dst := os.Stdout
+	if *vendor {
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatalf("Unable to load current director: %v", err)
+		}
+		*destination = filepath.Join(findModuleRoot(wd), "vendor", bundlePackage, "stub.go")
+	}
+	if len(*destination) > 0 {
+		if err := os.MkdirAll(filepath.Dir(*destination), os.ModePerm); err != nil {
+			log.Fatalf("Unable to create directory: %v", err)
+		}
+		f, err := os.Create(*destination)
+		if err != nil {
+			log.Fatalf("Failed opening destination file: %v", err)
+		}
+		defer f.Close()
+		dst = f
+	}
+
+	g := new(generator)
+	g.srcPackage = bundlePackage
+
+	if *copyrightFile != "" {
+		header, err := ioutil.ReadFile(*copyrightFile)
+		if err != nil {
+			log.Fatalf("Failed reading copyright file: %v", err)
+		}
+		g.copyrightHeader = string(header)
+	} else if len(headers) > 0 {
+		g.copyrightHeader = strings.Join(headers, "\n\n")
+	}
+
+	if err := g.GenerateBundle(bundlePackage, entries); err != nil {
+		log.Fatalf("Failed generating bundle: %v", err)
+	}
+	if _, err := dst.Write(g.Output()); err != nil {
+		log.Fatalf("Failed writing to destination: %v", err)
+	}
+
+	if err := copyLicenses(DeduplicateStrings(copyFrom)); err != nil {
+		log.Fatalf("Failed to find/copy licenses: %v", err)
+	}
+}
+
+var bundleIdentRegexp = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// bundlePrefix derives an identifier-safe prefix from the last two segments
+// of pkgPath, e.g. "database/sql/driver" -> "sql_driver". Paths that share
+// their last two segments get the same prefix.
+func bundlePrefix(pkgPath string) string {
+	parts := strings.Split(pkgPath, "/")
+	if len(parts) > 2 {
+		parts = parts[len(parts)-2:]
+	}
+	return bundleIdentRegexp.ReplaceAllString(strings.Join(parts, "_"), "_")
+}
+
+var packageClauseRegexp = regexp.MustCompile(`(?m)^package\s+\S+\s*\n`)
+
+// bundleFile is one bundled package's body, parsed once so it can be
+// renamed and merged via AST rewrite rather than textual substitution.
+type bundleFile struct {
+	fset *token.FileSet
+	file *ast.File
+}
+
+func parseBundleBody(body string) (*bundleFile, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", body, 0)
+	if err != nil {
+		return nil, fmt.Errorf("parsing package body for bundling: %w", err)
+	}
+	return &bundleFile{fset: fset, file: file}, nil
+}
+
+// renameExported prefixes bf's package-level declarations named in names
+// with prefix + "_", leaving identically-named shadowed locals alone.
+func (bf *bundleFile) renameExported(names []string, prefix string) {
+	nameSet := make(map[string]bool, len(names))
+	for _, name := range names {
+		if name != "" {
+			nameSet[name] = true
+		}
+	}
+	if len(nameSet) == 0 {
+		return
+	}
+	ast.Inspect(bf.file, func(n ast.Node) bool {
+		ident, ok := n.(*ast.Ident)
+		if !ok || ident.Obj == nil || !nameSet[ident.Name] {
+			return true
+		}
+		if bf.file.Scope.Lookup(ident.Name) != ident.Obj {
+			return true // shadowed by a local declaration, not the package-level one
+		}
+		ident.Name = prefix + "_" + ident.Name
+		return true
+	})
+}
+
+// splitImports removes bf's import declarations and returns them for the
+// caller to merge with the other entries'.
+func (bf *bundleFile) splitImports() []*ast.ImportSpec {
+	var specs []*ast.ImportSpec
+	rest := bf.file.Decls[:0]
+	for _, d := range bf.file.Decls {
+		if gd, ok := d.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			for _, spec := range gd.Specs {
+				specs = append(specs, spec.(*ast.ImportSpec))
+			}
+			continue
+		}
+		rest = append(rest, d)
+	}
+	bf.file.Decls = rest
+	return specs
+}
+
+// declName returns the name bundled by d, if d is a single-name top-level
+// type, func (non-method) or single-name var/const declaration.
+func declName(d ast.Decl) (string, bool) {
+	switch decl := d.(type) {
+	case *ast.FuncDecl:
+		if decl.Recv != nil {
+			return "", false // a method; tied to its (already renamed) receiver type
+		}
+		return decl.Name.Name, true
+	case *ast.GenDecl:
+		if len(decl.Specs) != 1 {
+			return "", false
+		}
+		switch spec := decl.Specs[0].(type) {
+		case *ast.TypeSpec:
+			return spec.Name.Name, true
+		case *ast.ValueSpec:
+			if len(spec.Names) == 1 {
+				return spec.Names[0].Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// dedupeHelpers drops bf's unexported declarations that are byte-identical
+// to one already seen, and renames (rather than drops) same-named ones that
+// aren't, so they don't shadow the earlier declaration.
+func (bf *bundleFile) dedupeHelpers(prefix string, seen map[string]string) {
+	kept := bf.file.Decls[:0]
+	for _, d := range bf.file.Decls {
+		name, ok := declName(d)
+		if !ok || ast.IsExported(name) {
+			kept = append(kept, d)
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := format.Node(&buf, bf.fset, d); err != nil {
+			kept = append(kept, d)
+			continue
+		}
+
+		if prev, ok := seen[name]; ok {
+			if prev == buf.String() {
+				continue
+			}
+			bf.renameExported([]string{name}, prefix)
+		} else {
+			seen[name] = buf.String()
+		}
+		kept = append(kept, d)
+	}
+	bf.file.Decls = kept
+}
+
+func (bf *bundleFile) body() (string, error) {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, bf.fset, bf.file); err != nil {
+		return "", fmt.Errorf("rendering bundled package body: %w", err)
+	}
+	return packageClauseRegexp.ReplaceAllString(buf.String(), ""), nil
+}
+
+// mergeImports deduplicates specs by import path and renders the result as
+// a single import block.
+func mergeImports(specs []*ast.ImportSpec) (string, error) {
+	seen := make(map[string]bool, len(specs))
+	var unique []ast.Spec
+	for _, spec := range specs {
+		if seen[spec.Path.Value] {
+			continue
+		}
+		seen[spec.Path.Value] = true
+		unique = append(unique, &ast.ImportSpec{Name: spec.Name, Path: spec.Path})
+	}
+	if len(unique) == 0 {
+		return "", nil
+	}
+
+	fset := token.NewFileSet()
+	file := &ast.File{
+		Name:  ast.NewIdent("bundle"),
+		Decls: []ast.Decl{&ast.GenDecl{Tok: token.IMPORT, Lparen: 1, Specs: unique}},
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		return "", fmt.Errorf("rendering merged import block: %w", err)
+	}
+	return packageClauseRegexp.ReplaceAllString(buf.String(), ""), nil
+}
+
+// stubConfig is the on-disk schema for depstubber.toml / depstubber.yaml.
+type stubConfig struct {
+	Packages map[string]packageConfig `toml:"packages" yaml:"packages"`
+}
+
+type packageConfig struct {
+	Types           []string `toml:"types" yaml:"types"`
+	Functions       []string `toml:"functions" yaml:"functions"`
+	Vars            []string `toml:"vars" yaml:"vars"`
+	Version         string   `toml:"version" yaml:"version"`
+	LicenseOverride string   `toml:"license_override" yaml:"license_override"`
+	BundleGroup     string   `toml:"bundle_group" yaml:"bundle_group"`
+}
+
+// isYAMLPath reports whether path should be read/written as YAML.
+func isYAMLPath(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// discoverConfig looks for a depstubber.toml/.yaml/.yml file at the module root.
+func discoverConfig(wd string) (string, bool) {
+	root := findModuleRoot(wd)
+	for _, name := range []string{"depstubber.toml", "depstubber.yaml", "depstubber.yml"} {
+		candidate := filepath.Join(root, name)
+		if exists, err := FileExists(candidate); err == nil && exists {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// loadConfig reads and parses a depstubber.toml or depstubber.yaml file.
+func loadConfig(path string) (*stubConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg stubConfig
+	if isYAMLPath(path) {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		return &cfg, nil
+	}
+	if _, err := toml.Decode(string(data), &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// writeConfigFile translates -print's auto-detected packages into a
+// depstubber.toml (or .yaml, chosen by path's extension) config file.
+func writeConfigFile(path string, pathToTypeNames, pathToFuncAndVarNames map[string][]string) error {
+	pkgPaths := DeduplicateStrings(append(mapKeys(pathToTypeNames), mapKeys(pathToFuncAndVarNames)...))
+	sort.Strings(pkgPaths)
+
+	cfg := stubConfig{Packages: make(map[string]packageConfig, len(pkgPaths))}
+	for _, pkgPath := range pkgPaths {
+		cfg.Packages[pkgPath] = packageConfig{
+			Types:     pathToTypeNames[pkgPath],
+			Functions: pathToFuncAndVarNames[pkgPath],
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if isYAMLPath(path) {
+		enc := yaml.NewEncoder(f)
+		defer enc.Close()
+		return enc.Encode(cfg)
+	}
+	return toml.NewEncoder(f).Encode(cfg)
+}
+
+func mapKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// runConfig generates (or, with -verify, checks) a stub for every package
+// entry in the config file at path. Packages sharing a non-empty
+// bundle_group are merged into one -bundle-style output instead.
+func runConfig(path string) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		log.Fatalf("Failed to load config %s: %v", path, err)
+	}
+
+	pkgPaths := make([]string, 0, len(cfg.Packages))
+	for pkgPath := range cfg.Packages {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+
+	res, err := loadResolver(".")
+	if err != nil {
+		log.Printf("Warning: module resolver unavailable, falling back to auto-discovered license dirs: %v", err)
+	}
+
+	// Explicit -destination names a single file; with -config (and no
+	// -vendor), treat it as a directory instead so packages don't collide.
+	baseDestination := *destination
+	perEntryDestination := !*vendor && baseDestination != ""
+
+	var standalone []string
+	groups := make(map[string][]string)
+	for _, pkgPath := range pkgPaths {
+		if group := cfg.Packages[pkgPath].BundleGroup; group != "" {
+			groups[group] = append(groups[group], pkgPath)
+		} else {
+			standalone = append(standalone, pkgPath)
+		}
+	}
+
+	for _, pkgPath := range standalone {
+		entry := cfg.Packages[pkgPath]
+		funcAndVarNames := append(append([]string{}, entry.Functions...), entry.Vars...)
+		licenseDirs := resolveDirs(res, ".", pkgPath, nil)
+		if perEntryDestination {
+			*destination = filepath.Join(baseDestination, pkgPath, "stub.go")
+		}
+
+		if *verifyMode {
+			verifyStub(pkgPath, entry.Version, entry.Types, funcAndVarNames, licenseDirs, entry.LicenseOverride)
+			continue
+		}
+
+		savedCopyrightFile := *copyrightFile
+		if entry.LicenseOverride != "" {
+			*copyrightFile = entry.LicenseOverride
+		}
+		createStubsIn("", pkgPath, entry.Version, entry.Types, funcAndVarNames, licenseDirs)
+		*copyrightFile = savedCopyrightFile
+	}
+
+	groupNames := make([]string, 0, len(groups))
+	for group := range groups {
+		groupNames = append(groupNames, group)
+	}
+	sort.Strings(groupNames)
+
+	for _, group := range groupNames {
+		if *verifyMode {
+			log.Fatalf("bundle_group %q: -verify doesn't support bundled groups; verify its packages individually", group)
+		}
+
+		members := groups[group]
+		entries := make([]bundleEntry, 0, len(members))
+		for _, pkgPath := range members {
+			entry := cfg.Packages[pkgPath]
+			entries = append(entries, bundleEntry{
+				pkgPath:         pkgPath,
+				version:         entry.Version,
+				typeNames:       entry.Types,
+				funcAndVarNames: append(append([]string{}, entry.Functions...), entry.Vars...),
+				licenseDirs:     resolveDirs(res, ".", pkgPath, nil),
+			})
+		}
+		if perEntryDestination {
+			*destination = filepath.Join(baseDestination, group, "stub.go")
+		}
+		createBundle(group, "", entries)
+	}
+}
+
+// verifyStub regenerates pkgPath's stub in memory and fails loudly if it
+// differs from what's already on disk.
+func verifyStub(pkgPath, version string, typeNames, funcAndVarNames, licenseDirs []string, licenseOverride string) {
+	pkg, err := reflectMode(pkgPath, typeNames, funcAndVarNames)
+	if err != nil {
+		log.Fatalf("Loading input for %s failed: %v", pkgPath, err)
+	}
+
+	g := new(generator)
+	g.srcPackage = pkgPath
+	g.srcVersion = version
+	g.srcExports = strings.Join(typeNames, ",")
+	g.srcFunctions = strings.Join(funcAndVarNames, ",")
+
+	copyrightPath := *copyrightFile
+	if licenseOverride != "" {
+		copyrightPath = licenseOverride
+	}
+
+	if copyrightPath != "" {
+		header, err := ioutil.ReadFile(copyrightPath)
+		if err != nil {
+			log.Fatalf("Failed reading copyright file: %v", err)
+		}
+		g.copyrightHeader = string(header)
+	} else if *licenseDetect {
+		if lic, err := detectLicense(licenseDirs, pkgPath, version); err == nil && lic != nil {
+			g.copyrightHeader, g.spdxIdentifier = lic.Text, lic.SPDX
+		}
+	}
+
+	if err := g.Generate(pkg); err != nil {
+		log.Fatalf("Failed generating stub for %s: %v", pkgPath, err)
+	}
+	want := g.Output()
+
+	dest := *destination
+	if *vendor || dest == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatalf("Unable to load current directory: %v", err)
+		}
+		dest = filepath.Join(findModuleRoot(wd), "vendor", pkgPath, "stub.go")
+	}
+
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		log.Fatalf("%s: stub missing or unreadable (%v); run depstubber -config to generate it", pkgPath, err)
+	}
+	if !bytes.Equal(got, want) {
+		log.Fatalf("%s: generated stub at %s is out of date; run depstubber -config to regenerate it", pkgPath, dest)
+	}
+}
+
 func usage() {
 	_, _ = io.WriteString(os.Stderr, usageText)
 	flag.PrintDefaults()
 }
 
+// splitImportPathVersion splits an argument of the form
+// "example.com/foo/bar@v1.2.3" into its import path and version. The
+// version is "" when no "@" suffix is present.
+func splitImportPathVersion(arg string) (importPath, version string) {
+	if i := strings.LastIndex(arg, "@"); i >= 0 {
+		return arg[:i], arg[i+1:]
+	}
+	return arg, ""
+}
+
+// packageResolvesLocally reports whether importPath can be loaded from the
+// current working directory's module, i.e. without needing -fetch.
+func packageResolvesLocally(importPath string) bool {
+	cmd := exec.Command("go", "list", "--", importPath)
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = ioutil.Discard
+	return cmd.Run() == nil
+}
+
+// moduleDownloadInfo mirrors the subset of `go mod download -json` output
+// that fetchPackage needs.
+type moduleDownloadInfo struct {
+	Path    string
+	Version string
+	Dir     string
+	Error   string
+}
+
+// fetchPackage downloads importPath@version ("latest" if version is "")
+// into a throwaway module and returns its directory (the caller must
+// os.RemoveAll it) and the version actually resolved.
+func fetchPackage(importPath, version string) (dir string, resolvedVersion string, err error) {
+	if version == "" {
+		version = "latest"
+	}
+
+	tmpDir, err := ioutil.TempDir("", "depstubber-fetch-")
+	if err != nil {
+		return "", "", fmt.Errorf("creating throwaway module: %v", err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	goMod := "module depstubber-fetch\n\ngo 1.16\n"
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "go.mod"), []byte(goMod), 0o644); err != nil {
+		cleanup()
+		return "", "", fmt.Errorf("writing throwaway go.mod: %v", err)
+	}
+
+	cmd := exec.Command("go", "mod", "download", "-json", importPath+"@"+version)
+	cmd.Dir = tmpDir
+	out, err := cmd.Output()
+	if err != nil {
+		cleanup()
+		return "", "", fmt.Errorf("go mod download %s@%s: %v", importPath, version, err)
+	}
+
+	var info moduleDownloadInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		cleanup()
+		return "", "", fmt.Errorf("parsing 'go mod download -json' output: %v", err)
+	}
+	if info.Error != "" {
+		cleanup()
+		return "", "", fmt.Errorf("go mod download %s@%s: %s", importPath, version, info.Error)
+	}
+
+	edit := exec.Command("go", "mod", "edit", "-require="+info.Path+"@"+info.Version)
+	edit.Dir = tmpDir
+	if out, err := edit.CombinedOutput(); err != nil {
+		cleanup()
+		return "", "", fmt.Errorf("go mod edit -require=%s@%s: %v\n%s", info.Path, info.Version, err, out)
+	}
+
+	return tmpDir, info.Version, nil
+}
+
 const usageText = `depstubber uses reflection to generate a stub for a library.
 
 It generates stub methods and functions by building a program
 that uses reflection. It requires two or three non-flag
 arguments: an import path, and a comma-separated list of
-symbols, and a comma-separated list of function names.
+symbols, and a comma-separated list of function names. The
+import path may carry an "@version" suffix (default "latest");
+if the package isn't resolvable from the current module, or
+-fetch is set, it is downloaded into a throwaway module first.
+Alternatively, -config points at a depstubber.toml (or .yaml) file
+listing per-package types/functions/vars, for allowlists too large
+to fit on a command line; -print -config-out bootstraps one from
+auto-detection, and -config -verify checks generated stubs for
+drift in CI without rewriting them.
 Examples:
 	depstubber database/sql/driver Conn,Driver
 	depstubber github.com/Masterminds/squirrel '' Expr
+	depstubber -fetch example.com/foo/bar@v1.2.3 Type1,Type2 ''
+	depstubber -config depstubber.toml -verify
 
 `
 
 type generator struct {
 	buf                                  bytes.Buffer
 	srcPackage, srcExports, srcFunctions string // may be empty
+	srcVersion                           string // may be empty; set from an "@version" argument, a config entry's version, or -fetch
 	copyrightHeader                      string
+	spdxIdentifier                       string // e.g. "MIT"; set when -license-detect classified the upstream license
 
 	packageMap map[string]string // map from import path to package name
 }
@@ -210,6 +975,11 @@ func (g *generator) Generate(pkg *model.PackedPkg) error {
 	g.p("// This is a simple stub for %s, strictly for use in testing.", g.srcPackage)
 	g.p("")
 
+	if g.spdxIdentifier != "" {
+		g.p("// SPDX-License-Identifier: %s", g.spdxIdentifier)
+		g.p("")
+	}
+
 	if g.copyrightHeader != "" {
 		g.p("// See the license below for information about the licensing of the original library.")
 		g.p("")
@@ -224,7 +994,11 @@ func (g *generator) Generate(pkg *model.PackedPkg) error {
 		g.p("// See the LICENSE file for information about the licensing of the original library.")
 	}
 
-	g.p("// Source: %s (exports: %s; functions: %s)", g.srcPackage, g.srcExports, g.srcFunctions)
+	if g.srcVersion != "" {
+		g.p("// Source: %s@%s (exports: %s; functions: %s)", g.srcPackage, g.srcVersion, g.srcExports, g.srcFunctions)
+	} else {
+		g.p("// Source: %s (exports: %s; functions: %s)", g.srcPackage, g.srcExports, g.srcFunctions)
+	}
 	g.p("")
 
 	g.p("")
@@ -234,6 +1008,166 @@ func (g *generator) Generate(pkg *model.PackedPkg) error {
 	return nil
 }
 
+// GenerateBundle merges entries into a single file for package
+// bundlePackageName, analogous to golang.org/x/tools/cmd/bundle.
+func (g *generator) GenerateBundle(bundlePackageName string, entries []bundleEntry) error {
+	g.p("// Code generated by depstubber -bundle. DO NOT EDIT.")
+	g.p("// This is a bundled stub combining %d package(s), strictly for use in testing.", len(entries))
+	g.p("")
+
+	if g.copyrightHeader != "" {
+		g.p("// See the license(s) below for information about the licensing of the original libraries.")
+		g.p("")
+		for _, line := range strings.Split(g.copyrightHeader, "\n") {
+			g.p("// %s", line)
+		}
+		g.p("")
+	} else {
+		g.p("// See the LICENSE file(s) for information about the licensing of the original libraries.")
+	}
+	g.p("")
+
+	g.p("package %s", path.Base(bundlePackageName))
+	g.p("")
+
+	files := make([]*bundleFile, len(entries))
+	var allImports []*ast.ImportSpec
+	seenHelpers := make(map[string]string)
+	for i, e := range entries {
+		bf, err := parseBundleBody(e.pkg.Body)
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.pkgPath, err)
+		}
+		prefix := bundlePrefix(e.pkgPath)
+		bf.renameExported(e.typeNames, prefix)
+		bf.renameExported(e.funcAndVarNames, prefix)
+		bf.dedupeHelpers(prefix, seenHelpers)
+		allImports = append(allImports, bf.splitImports()...)
+		files[i] = bf
+	}
+
+	importBlock, err := mergeImports(allImports)
+	if err != nil {
+		return err
+	}
+	if importBlock != "" {
+		g.p(importBlock)
+		g.p("")
+	}
+
+	for i, e := range entries {
+		prefix := bundlePrefix(e.pkgPath)
+		g.srcExports = strings.Join(e.typeNames, ",")
+		g.srcFunctions = strings.Join(e.funcAndVarNames, ",")
+
+		body, err := files[i].body()
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.pkgPath, err)
+		}
+
+		g.p("// Source: %s (exports: %s; functions: %s; prefix: %s)", e.pkgPath, g.srcExports, g.srcFunctions, prefix)
+		g.p("")
+		g.p(body)
+		g.p("")
+	}
+
+	return nil
+}
+
+type detectedLicense struct {
+	SPDX string // e.g. "MIT", "Apache-2.0", "BSD-3-Clause"
+	Path string // path to the license file that was scanned
+	Text string // raw contents of the license file
+}
+
+var licenseFileNames = []string{"LICENSE", "LICENSE.txt", "LICENSE.md", "COPYING", "NOTICE"}
+
+// findLicenseFile also falls back to modulePath@version's directory under
+// the module cache when licenseDirs doesn't contain a license.
+func findLicenseFile(licenseDirs []string, modulePath, version string) (string, error) {
+	dirs := append([]string{}, licenseDirs...)
+
+	if version != "" {
+		modCache := os.Getenv("GOMODCACHE")
+		if modCache == "" {
+			gopath := os.Getenv("GOPATH")
+			if gopath == "" {
+				var err error
+				gopath, err = os.UserHomeDir()
+				if err != nil {
+					return "", fmt.Errorf("resolving module cache: %v", err)
+				}
+				gopath = filepath.Join(gopath, "go")
+			}
+			modCache = filepath.Join(gopath, "pkg", "mod")
+		}
+		dirs = append(dirs, filepath.Join(modCache, escapeModulePath(modulePath)+"@"+version))
+	}
+
+	for _, dir := range dirs {
+		for _, name := range licenseFileNames {
+			candidate := filepath.Join(dir, name)
+			if exists, err := FileExists(candidate); err != nil {
+				return "", err
+			} else if exists {
+				return candidate, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// escapeModulePath applies Go's module cache escaping: each uppercase
+// letter becomes '!' followed by its lowercase form.
+func escapeModulePath(path string) string {
+	var buf strings.Builder
+	for _, r := range path {
+		if r >= 'A' && r <= 'Z' {
+			buf.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// detectLicense returns a nil *detectedLicense (and no error) when no
+// license file is found or no match meets -license-min-confidence.
+func detectLicense(licenseDirs []string, modulePath, version string) (*detectedLicense, error) {
+	path, err := findLicenseFile(licenseDirs, modulePath, version)
+	if err != nil {
+		return nil, fmt.Errorf("locating license file: %v", err)
+	}
+	if path == "" {
+		return nil, nil
+	}
+
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading license file %s: %v", path, err)
+	}
+
+	cov := licensecheck.Scan(text)
+	var best licensecheck.Match
+	for _, m := range cov.Match {
+		if m.Percent/100 < *licenseMinConfidence {
+			continue
+		}
+		if m.Percent > best.Percent {
+			best = m
+		}
+	}
+	if best.ID == "" {
+		return nil, nil
+	}
+
+	return &detectedLicense{
+		SPDX: best.ID,
+		Path: path,
+		Text: string(text),
+	}, nil
+}
+
 // Output returns the generator's output, formatted in the standard Go style.
 func (g *generator) Output() []byte {
 	// Format source and add or remove import statements as necessary:
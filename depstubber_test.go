@@ -0,0 +1,153 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsYAMLPath(t *testing.T) {
+	cases := map[string]bool{
+		"depstubber.toml": false,
+		"depstubber.yaml": true,
+		"depstubber.yml":  true,
+		"depstubber.YAML": true,
+	}
+	for in, want := range cases {
+		if got := isYAMLPath(in); got != want {
+			t.Errorf("isYAMLPath(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestLoadConfigRoundTrip(t *testing.T) {
+	for _, ext := range []string{"toml", "yaml"} {
+		t.Run(ext, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "depstubber."+ext)
+			in := map[string][]string{
+				"database/sql/driver": {"Conn", "Driver"},
+			}
+			funcs := map[string][]string{
+				"database/sql/driver": {"Open"},
+			}
+			if err := writeConfigFile(path, in, funcs); err != nil {
+				t.Fatalf("writeConfigFile: %v", err)
+			}
+
+			cfg, err := loadConfig(path)
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			entry, ok := cfg.Packages["database/sql/driver"]
+			if !ok {
+				t.Fatalf("loaded config missing package entry: %+v", cfg)
+			}
+			if strings.Join(entry.Types, ",") != "Conn,Driver" || strings.Join(entry.Functions, ",") != "Open" {
+				t.Errorf("round-tripped entry = %+v, want Types [Conn Driver], Functions [Open]", entry)
+			}
+		})
+	}
+}
+
+func TestBundlePrefix(t *testing.T) {
+	cases := map[string]string{
+		"database/sql/driver":        "sql_driver",
+		"reflect":                    "reflect",
+		"example.com/foo/bar":        "foo_bar",
+		"golang.org/x/tools/imports": "tools_imports",
+	}
+	for in, want := range cases {
+		if got := bundlePrefix(in); got != want {
+			t.Errorf("bundlePrefix(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestBundleFileRenameExported(t *testing.T) {
+	const body = `package driver
+
+type Conn interface {
+	Close() error
+}
+
+func Open(name string) (Conn, error) { return nil, nil }
+
+// unrelated identifier of the same name in a different scope must survive
+func other() {
+	Conn := 1
+	_ = Conn
+}
+`
+	bf, err := parseBundleBody(body)
+	if err != nil {
+		t.Fatalf("parseBundleBody: %v", err)
+	}
+	bf.renameExported([]string{"Conn"}, "sql_driver")
+	bf.renameExported([]string{"Open"}, "sql_driver")
+
+	out, err := bf.body()
+	if err != nil {
+		t.Fatalf("body: %v", err)
+	}
+	if !strings.Contains(out, "sql_driver_Conn interface") {
+		t.Errorf("type declaration not renamed:\n%s", out)
+	}
+	if !strings.Contains(out, "(sql_driver_Conn, error)") {
+		t.Errorf("return type reference not renamed:\n%s", out)
+	}
+	if !strings.Contains(out, "func sql_driver_Open") {
+		t.Errorf("func declaration not renamed:\n%s", out)
+	}
+	if !strings.Contains(out, "Conn := 1") {
+		t.Errorf("shadowed local identifier was incorrectly renamed:\n%s", out)
+	}
+}
+
+func TestMergeImportsDeduplicates(t *testing.T) {
+	a, err := parseBundleBody("package a\n\nimport \"reflect\"\n\nvar _ = reflect.TypeOf\n")
+	if err != nil {
+		t.Fatalf("parseBundleBody a: %v", err)
+	}
+	b, err := parseBundleBody("package b\n\nimport \"reflect\"\n\nvar _ = reflect.TypeOf\n")
+	if err != nil {
+		t.Fatalf("parseBundleBody b: %v", err)
+	}
+
+	specs := append(a.splitImports(), b.splitImports()...)
+	block, err := mergeImports(specs)
+	if err != nil {
+		t.Fatalf("mergeImports: %v", err)
+	}
+	if n := strings.Count(block, `"reflect"`); n != 1 {
+		t.Errorf("mergeImports produced %d \"reflect\" imports, want 1:\n%s", n, block)
+	}
+}
+
+func TestSplitImportPathVersion(t *testing.T) {
+	cases := []struct {
+		arg, wantPath, wantVersion string
+	}{
+		{"example.com/foo/bar", "example.com/foo/bar", ""},
+		{"example.com/foo/bar@v1.2.3", "example.com/foo/bar", "v1.2.3"},
+		{"example.com/foo/bar@latest", "example.com/foo/bar", "latest"},
+	}
+	for _, c := range cases {
+		gotPath, gotVersion := splitImportPathVersion(c.arg)
+		if gotPath != c.wantPath || gotVersion != c.wantVersion {
+			t.Errorf("splitImportPathVersion(%q) = (%q, %q), want (%q, %q)", c.arg, gotPath, gotVersion, c.wantPath, c.wantVersion)
+		}
+	}
+}
+
+func TestEscapeModulePath(t *testing.T) {
+	cases := map[string]string{
+		"rsc.io/quote":          "rsc.io/quote",
+		"github.com/BurntSushi": "github.com/!burnt!sushi",
+		"golang.org/x/tools":    "golang.org/x/tools",
+	}
+	for in, want := range cases {
+		if got := escapeModulePath(in); got != want {
+			t.Errorf("escapeModulePath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
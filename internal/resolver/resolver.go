@@ -0,0 +1,223 @@
+// Package resolver resolves package import paths to on-disk directories by
+// loading the module graph once with `go list -m -json all`, rather than
+// shelling out to `go list` per package.
+package resolver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Module is the subset of `go list -m -json` output the resolver needs.
+type Module struct {
+	Path    string
+	Version string
+	Dir     string
+	Main    bool
+}
+
+// Resolver resolves import paths to the module that provides them, without
+// invoking the go tool for every lookup.
+type Resolver struct {
+	// modulePaths is modules' Path fields, sorted so Save's output is
+	// deterministic across runs.
+	modulePaths []string
+	modules     map[string]Module
+}
+
+// New runs `go list -m -json all` once in dir and builds a Resolver from
+// its output.
+func New(dir string) (*Resolver, error) {
+	cmd := exec.Command("go", "list", "-m", "-json", "all")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list -m -json all: %w", err)
+	}
+	return newFromJSON(out)
+}
+
+func newFromJSON(data []byte) (*Resolver, error) {
+	r := &Resolver{modules: make(map[string]Module)}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var m Module
+		if err := dec.Decode(&m); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("decoding module list: %w", err)
+		}
+		r.modules[m.Path] = m
+		r.modulePaths = append(r.modulePaths, m.Path)
+	}
+	sort.Strings(r.modulePaths)
+	return r, nil
+}
+
+// Lookup finds the module that provides importPath, by walking up
+// importPath's path segments looking for the longest module path that is a
+// prefix of it.
+func (r *Resolver) Lookup(importPath string) (Module, bool) {
+	for path := importPath; path != "."; path = parentPath(path) {
+		if m, ok := r.modules[path]; ok {
+			return m, true
+		}
+		if path == parentPath(path) {
+			break
+		}
+	}
+	return Module{}, false
+}
+
+// Dir returns the directory importPath can be found in on disk, derived
+// from its owning module's Dir plus the remaining path suffix.
+func (r *Resolver) Dir(importPath string) (string, bool) {
+	m, ok := r.Lookup(importPath)
+	if !ok || m.Dir == "" {
+		return "", false
+	}
+	suffix := strings.TrimPrefix(strings.TrimPrefix(importPath, m.Path), "/")
+	return filepath.Join(m.Dir, filepath.FromSlash(suffix)), true
+}
+
+// Resolve looks up importPath in the in-memory table and, if it isn't
+// present (e.g. a transitive dependency `go list -m all` didn't surface),
+// falls back to a single on-demand `go list -json <pkg>` call and remembers
+// the result for subsequent lookups. Package mode (rather than `go list -m`,
+// which only accepts a module path, not an arbitrary package import path
+// like "golang.org/x/tools/imports") is used because importPath is usually
+// a sub-package of the module that provides it.
+func (r *Resolver) Resolve(dir, importPath string) (Module, error) {
+	if m, ok := r.Lookup(importPath); ok {
+		return m, nil
+	}
+
+	cmd := exec.Command("go", "list", "-json", "-mod=mod", importPath)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return Module{}, fmt.Errorf("go list -json -mod=mod %s: %w", importPath, err)
+	}
+	m, err := parsePackageModule(out)
+	if err != nil {
+		return Module{}, fmt.Errorf("decoding package info for %s: %w", importPath, err)
+	}
+
+	r.modules[m.Path] = m
+	r.modulePaths = append(r.modulePaths, m.Path)
+	sort.Strings(r.modulePaths)
+	return m, nil
+}
+
+// parsePackageModule extracts the owning module from `go list -json`
+// output for a single package.
+func parsePackageModule(data []byte) (Module, error) {
+	var info struct {
+		Module Module
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return Module{}, err
+	}
+	if info.Module.Path == "" {
+		return Module{}, errors.New("no module information in package info")
+	}
+	return info.Module, nil
+}
+
+// ResolveDir is Dir's Resolve-backed counterpart: it returns importPath's
+// on-disk directory, running the on-demand `go list -json` fallback (see
+// Resolve) when importPath's module isn't already in the in-memory table.
+func (r *Resolver) ResolveDir(dir, importPath string) (string, error) {
+	m, err := r.Resolve(dir, importPath)
+	if err != nil || m.Dir == "" {
+		return "", err
+	}
+	suffix := strings.TrimPrefix(strings.TrimPrefix(importPath, m.Path), "/")
+	return filepath.Join(m.Dir, filepath.FromSlash(suffix)), nil
+}
+
+func parentPath(importPath string) string {
+	i := strings.LastIndex(importPath, "/")
+	if i < 0 {
+		return "."
+	}
+	return importPath[:i]
+}
+
+// CacheKey hashes goSumPath's contents, so a resolver built for one
+// dependency graph isn't reused for another.
+func CacheKey(goSumPath string) (string, error) {
+	data, err := ioutil.ReadFile(goSumPath)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", goSumPath, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// cacheDir is where resolution tables are persisted, keyed by go.sum hash,
+// so that repeated `depstubber -auto` runs during `go generate` don't have
+// to rebuild the module graph every time.
+func cacheDir() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, "depstubber", "resolver")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// LoadCached returns the resolver cached under key, if one exists.
+func LoadCached(key string) (*Resolver, bool) {
+	dir, err := cacheDir()
+	if err != nil {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, key+".json"))
+	if err != nil {
+		return nil, false
+	}
+	r, err := newFromJSON(data)
+	if err != nil {
+		return nil, false
+	}
+	return r, true
+}
+
+// Save persists r under key for future invocations to pick up via
+// LoadCached.
+func (r *Resolver) Save(key string) error {
+	dir, err := cacheDir()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, key+".json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, path := range r.modulePaths {
+		if err := enc.Encode(r.modules[path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package resolver
+
+import "testing"
+
+func newTestResolver() (*Resolver, error) {
+	const data = `{"Path":"example.com/mod","Version":"v1.0.0","Dir":"/cache/example.com/mod@v1.0.0","Main":false}
+{"Path":"example.com/mod/sub","Version":"v1.0.0","Dir":"/cache/example.com/mod@v1.0.0/sub","Main":false}
+{"Path":"example.com/app","Version":"","Dir":"/src/app","Main":true}
+`
+	return newFromJSON([]byte(data))
+}
+
+func TestLookup(t *testing.T) {
+	r, err := newTestResolver()
+	if err != nil {
+		t.Fatalf("newTestResolver: %v", err)
+	}
+
+	cases := []struct {
+		importPath string
+		wantPath   string
+		wantOK     bool
+	}{
+		{"example.com/mod", "example.com/mod", true},
+		{"example.com/mod/pkg", "example.com/mod", true},
+		{"example.com/mod/sub", "example.com/mod/sub", true},
+		{"example.com/mod/sub/pkg", "example.com/mod/sub", true},
+		{"example.com/other", "", false},
+	}
+	for _, c := range cases {
+		m, ok := r.Lookup(c.importPath)
+		if ok != c.wantOK || (ok && m.Path != c.wantPath) {
+			t.Errorf("Lookup(%q) = (%+v, %v), want path %q ok %v", c.importPath, m, ok, c.wantPath, c.wantOK)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	r, err := newTestResolver()
+	if err != nil {
+		t.Fatalf("newTestResolver: %v", err)
+	}
+
+	dir, ok := r.Dir("example.com/mod/sub/pkg")
+	if !ok {
+		t.Fatal("Dir: not found")
+	}
+	if want := "/cache/example.com/mod@v1.0.0/sub/pkg"; dir != want {
+		t.Errorf("Dir = %q, want %q", dir, want)
+	}
+
+	if _, ok := r.Dir("example.com/other"); ok {
+		t.Error("Dir: expected not found for unrelated module")
+	}
+}
+
+func TestParsePackageModule(t *testing.T) {
+	const data = `{"ImportPath":"golang.org/x/tools/imports","Module":{"Path":"golang.org/x/tools","Version":"v0.1.0","Dir":"/cache/golang.org/x/tools@v0.1.0","Main":false}}`
+	m, err := parsePackageModule([]byte(data))
+	if err != nil {
+		t.Fatalf("parsePackageModule: %v", err)
+	}
+	if m.Path != "golang.org/x/tools" || m.Dir != "/cache/golang.org/x/tools@v0.1.0" {
+		t.Errorf("parsePackageModule(%s) = %+v, want Path golang.org/x/tools, Dir /cache/golang.org/x/tools@v0.1.0", data, m)
+	}
+}
+
+func TestParsePackageModuleMissing(t *testing.T) {
+	if _, err := parsePackageModule([]byte(`{"ImportPath":"example.com/nomodule"}`)); err == nil {
+		t.Error("parsePackageModule: expected error for package info without module")
+	}
+}
+
+func TestParentPath(t *testing.T) {
+	cases := map[string]string{
+		"a/b/c": "a/b",
+		"a/b":   "a",
+		"a":     ".",
+		".":     ".",
+	}
+	for in, want := range cases {
+		if got := parentPath(in); got != want {
+			t.Errorf("parentPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}